@@ -3,8 +3,10 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"math"
 	"os"
 	"sort"
 	"strconv"
@@ -13,6 +15,8 @@ import (
 	"cmd/internal/objfile"
 )
 
+var htmlOut = flag.String("html", "", "render a small-multiples speedup plot to this file instead of printing a text report")
+
 func main() {
 	flag.Parse()
 	args := flag.Args()
@@ -24,51 +28,131 @@ func main() {
 	if err != nil {
 		fatalln(err.Error())
 	}
-	// first sample should have the 0 experiment. Keep a reference to it
-	nullexp := samples[0]
+	if len(samples) == 0 {
+		fatalln("no experiments in profile")
+	}
 
-	// make an index of experiments concerning the same callsite
-	index := make(map[uint64][]*sample)
+	// resolve file:line for any sample that didn't already carry it (the
+	// text format only records a pc, so we need the symbol table; JSON
+	// and Coz profiles already embed file:line)
+	needsPCLine := false
 	for _, s := range samples {
-		i := index[s.pc]
-		i = append(i, s)
-		index[s.pc] = i
+		if s.file == "" {
+			needsPCLine = true
+			break
+		}
 	}
-	// sort each callsite by slowdown
-	for _, s := range index {
-		sort.Sort(bySpeedup(s))
+	if needsPCLine {
+		obj, err := objfile.Open(args[1])
+		if err != nil {
+			fatalln(err.Error())
+		}
+		pcln, err := obj.PCLineTable()
+		if err != nil {
+			fatalln(err.Error())
+		}
+		for _, s := range samples {
+			if s.file == "" {
+				s.file, s.line, _ = pcln.PCToLine(s.pc - 1)
+			}
+		}
 	}
-	// get a symbol table to turn addresses into file:line
-	obj, err := objfile.Open(args[1])
-	if err != nil {
-		fatalln(err.Error())
+
+	// make an index of experiments concerning the same file:line, since
+	// causal profiling experiments are now run at line granularity rather
+	// than only at function entry. Each site is further split by the
+	// progress point the sample measures, since a single run can register
+	// several (e.g. request latency and background GC throughput).
+	index := make(map[callsite]map[string][]*sample)
+	for _, s := range samples {
+		cs := callsite{s.file, s.line}
+		if index[cs] == nil {
+			index[cs] = make(map[string][]*sample)
+		}
+		index[cs][s.point] = append(index[cs][s.point], s)
 	}
-	pcln, err := obj.PCLineTable()
-	if err != nil {
-		fatalln(err.Error())
+	// sort each point's experiments by speedup
+	for _, bypoint := range index {
+		for _, s := range bypoint {
+			sort.Sort(bySpeedup(s))
+		}
 	}
-	for pc, i := range index {
-		file, line, fn := pcln.PCToLine(pc - 1)
-		if fn == nil {
-			fmt.Printf("%#x\n", pc)
-		} else {
-			fmt.Printf("%#x %s:%d\n", pc, file, line)
+
+	if *htmlOut != "" {
+		if err := writeHTMLReport(*htmlOut, index); err != nil {
+			fatalln(err.Error())
 		}
-		fmt.Println(nullexp.nsPerOp)
-		for _, s := range i {
-			percent := float64(s.nsPerOp-nullexp.nsPerOp) / float64(nullexp.nsPerOp)
-			percent *= 100
-			fmt.Printf("%3d%%\t%dns\t%+.3g%%\n", s.speedup, s.nsPerOp, percent)
+		return
+	}
+
+	for cs, bypoint := range index {
+		for point, i := range bypoint {
+			null := findNull(i)
+			if null == nil {
+				continue
+			}
+			if cs.file == "" {
+				fmt.Printf("%#x\n", i[0].pc)
+			} else {
+				fmt.Printf("%s:%d\n", cs.file, cs.line)
+			}
+			fmt.Printf("  point %s (%s), null %dns/op +/- %.0f (%d samples)\n",
+				point, i[0].kind, null.nsPerOp, null.ci95, null.samples)
+			for _, s := range i {
+				if !s.significant(null) {
+					continue // CI overlaps the null; not distinguishable from noise
+				}
+				percent := float64(s.nsPerOp-null.nsPerOp) / float64(null.nsPerOp)
+				percent *= 100
+				fmt.Printf("%3d%%\t%dns +/- %.0f\t%+.3g%%\t(%d samples)\n",
+					s.speedup, s.nsPerOp, s.ci95, percent, s.samples)
+			}
 		}
 		fmt.Println()
 	}
+}
 
+// findNull returns the null (0% speedup) experiment in samples, or nil if
+// there isn't one yet.
+func findNull(samples []*sample) *sample {
+	for _, s := range samples {
+		if s.speedup == 0 {
+			return s
+		}
+	}
+	return nil
 }
 
 type sample struct {
-	pc      uint64
-	speedup int
-	nsPerOp int64
+	pc       uint64
+	speedup  int
+	nsPerOp  int64
+	ops      int64
+	samples  int
+	stddev   float64
+	ci95     float64
+	point    string
+	kind     string
+	file     string
+	line     int
+	duration int64 // run duration in ns; only set while parsing Coz profiles, see readCozProfFile
+}
+
+// significant reports whether s's measured ns/op differs from null's by
+// more than the two experiments' combined 95% confidence interval, i.e.
+// whether the effect is unlikely to be noise.
+func (s *sample) significant(null *sample) bool {
+	if s == null {
+		return true
+	}
+	diff := math.Abs(float64(s.nsPerOp - null.nsPerOp))
+	return diff > s.ci95+null.ci95
+}
+
+// callsite identifies the source location an experiment was run at.
+type callsite struct {
+	file string
+	line int
 }
 
 type bySpeedup []*sample
@@ -77,22 +161,78 @@ func (b bySpeedup) Len() int           { return len(b) }
 func (b bySpeedup) Less(i, j int) bool { return b[i].speedup < b[j].speedup }
 func (b bySpeedup) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
 
+// jsonResult mirrors runtime/causalprof.Result, minus its runDuration
+// field; duplicated here so this command doesn't need to import the
+// runtime package.
+type jsonResult struct {
+	PC      uint64  `json:"pc"`
+	File    string  `json:"file"`
+	Line    int     `json:"line"`
+	Func    string  `json:"func"`
+	Speedup int     `json:"speedup"`
+	Point   string  `json:"point"`
+	Kind    string  `json:"kind"`
+	NsPerOp int64   `json:"nsPerOp"`
+	Ops     int64   `json:"ops"`
+	Samples int     `json:"samples"`
+	StdDev  float64 `json:"stddev"`
+	CI95    float64 `json:"ci95"`
+}
+
 func readProfFile(path string) ([]*sample, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
 
-	var samples []*sample
+	var lines []string
 	scan := bufio.NewScanner(f)
 	for scan.Scan() {
-		s := scan.Text()
-		if len(s) < 1 || s[0] == '#' {
+		lines = append(lines, scan.Text())
+	}
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, l := range lines {
+		l = strings.TrimSpace(l)
+		if l == "" || l[0] == '#' {
+			continue
+		}
+		switch {
+		case l[0] == '{':
+			return readJSONProfFile(lines)
+		case strings.HasPrefix(l, "experiment") || strings.HasPrefix(l, "startup"):
+			return readCozProfFile(lines)
+		default:
+			return readTextProfFile(lines)
+		}
+	}
+	return nil, nil
+}
+
+// readTextProfFile parses the "# ..." comment / "pc speedup nsPerOp ops
+// samples stddev ci95" data line pairs written by the Text format. The
+// point name and kind come from the "# point <name> <kind>" comment that
+// precedes each data line.
+func readTextProfFile(lines []string) ([]*sample, error) {
+	var out []*sample
+	var pointName, pointKind string
+	for _, l := range lines {
+		if len(l) < 1 {
+			continue
+		}
+		if l[0] == '#' {
+			fields := strings.Fields(l)
+			if len(fields) == 4 && fields[1] == "point" {
+				pointName, pointKind = fields[2], fields[3]
+			}
 			continue
 		}
-		fields := strings.Fields(s)
-		if len(fields) != 3 {
-			return nil, fmt.Errorf("corrupt causalprof file, had ", len(fields), "fields; expected 3")
+		fields := strings.Fields(l)
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("corrupt causalprof file, had %d fields; expected 7", len(fields))
 		}
 		pc, err := strconv.ParseUint(fields[0], 0, 64)
 		if err != nil {
@@ -106,17 +246,127 @@ func readProfFile(path string) ([]*sample, error) {
 		if err != nil {
 			return nil, err
 		}
-		samples = append(samples, &sample{
+		ops, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		numSamples, err := strconv.Atoi(fields[4])
+		if err != nil {
+			return nil, err
+		}
+		stddev, err := strconv.ParseFloat(fields[5], 64)
+		if err != nil {
+			return nil, err
+		}
+		ci95, err := strconv.ParseFloat(fields[6], 64)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, &sample{
 			pc:      pc,
 			speedup: speedup,
 			nsPerOp: nsPerOp,
+			ops:     ops,
+			samples: numSamples,
+			stddev:  stddev,
+			ci95:    ci95,
+			point:   pointName,
+			kind:    pointKind,
 		})
 	}
-	return samples, scan.Err()
+	return out, nil
+}
+
+func readJSONProfFile(lines []string) ([]*sample, error) {
+	var samples []*sample
+	for _, l := range lines {
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+		var r jsonResult
+		if err := json.Unmarshal([]byte(l), &r); err != nil {
+			return nil, err
+		}
+		samples = append(samples, &sample{
+			pc:      r.PC,
+			speedup: r.Speedup,
+			nsPerOp: r.NsPerOp,
+			ops:     r.Ops,
+			samples: r.Samples,
+			stddev:  r.StdDev,
+			ci95:    r.CI95,
+			point:   r.Point,
+			kind:    r.Kind,
+			file:    r.File,
+			line:    r.Line,
+		})
+	}
+	return samples, nil
+}
+
+// readCozProfFile reads the Coz-inspired text format causalprof emits
+// (see the Coz Format constant in runtime/causalprof): an "experiment"
+// record carrying the selected file:line and speedup, followed by one
+// throughput-point/latency-point record per registered progress point.
+// Its field names are this tool's own rather than upstream Coz's, so it
+// only round-trips profiles causalprof itself wrote.
+func readCozProfFile(lines []string) ([]*sample, error) {
+	var samples []*sample
+	var cur *sample
+	for _, l := range lines {
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+		fields := strings.Fields(l)
+		kv := make(map[string]string, len(fields)-1)
+		for _, field := range fields[1:] {
+			if i := strings.IndexByte(field, '='); i >= 0 {
+				kv[field[:i]] = field[i+1:]
+			}
+		}
+		switch fields[0] {
+		case "experiment":
+			cur = &sample{file: kv["selected-file"]}
+			cur.line, _ = strconv.Atoi(kv["selected-line"])
+			if f, err := strconv.ParseFloat(kv["speedup"], 64); err == nil {
+				cur.speedup = int(f * 100)
+			}
+			cur.duration, _ = strconv.ParseInt(kv["duration"], 10, 64)
+		case "throughput-point", "latency-point":
+			if cur == nil {
+				continue
+			}
+			s := *cur
+			s.point = kv["name"]
+			if fields[0] == "latency-point" {
+				s.kind = "latency"
+				s.nsPerOp, _ = strconv.ParseInt(kv["nsPerOp"], 10, 64)
+				s.ops, _ = strconv.ParseInt(kv["ops"], 10, 64)
+			} else {
+				// throughput-point records don't carry nsPerOp directly
+				// (writeResult only writes the delta); derive a
+				// comparable one from the experiment's total duration so
+				// report/significant's (s.nsPerOp-null.nsPerOp)/null.nsPerOp
+				// math doesn't divide by zero for these samples.
+				s.kind = "throughput"
+				s.ops, _ = strconv.ParseInt(kv["delta"], 10, 64)
+				if s.ops > 0 {
+					s.nsPerOp = s.duration / s.ops
+				}
+			}
+			s.samples, _ = strconv.Atoi(kv["samples"])
+			s.stddev, _ = strconv.ParseFloat(kv["stddev"], 64)
+			s.ci95, _ = strconv.ParseFloat(kv["ci95"], 64)
+			samples = append(samples, &s)
+		}
+	}
+	return samples, nil
 }
 
 func usage() {
-	fmt.Fprintln(os.Stderr, "usage: causalprof file program")
+	fmt.Fprintln(os.Stderr, "usage: causalprof [-html out.html] file program")
 	os.Exit(1)
 }
 
@@ -0,0 +1,87 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestReadJSONProfFileRoundTrip(t *testing.T) {
+	lines := []string{
+		`{"pc":4096,"file":"a.go","line":10,"func":"f","speedup":10,"point":"reqs","kind":"latency","nsPerOp":500,"ops":100,"samples":20,"stddev":5.5,"ci95":1.5}`,
+	}
+	samples, err := readJSONProfFile(lines)
+	if err != nil {
+		t.Fatalf("readJSONProfFile: %v", err)
+	}
+	if len(samples) != 1 {
+		t.Fatalf("got %d samples, want 1", len(samples))
+	}
+	s := samples[0]
+	if s.file != "a.go" || s.line != 10 || s.speedup != 10 || s.point != "reqs" || s.kind != "latency" {
+		t.Errorf("readJSONProfFile round-trip mismatch: %+v", s)
+	}
+	if s.nsPerOp != 500 || s.ops != 100 {
+		t.Errorf("nsPerOp/ops = %d/%d, want 500/100", s.nsPerOp, s.ops)
+	}
+}
+
+func TestReadCozProfFileLatencyPoint(t *testing.T) {
+	lines := []string{
+		"experiment\tselected-file=a.go\tselected-line=10\tspeedup=0.10\tduration=1000000",
+		"latency-point\tname=reqs\tnsPerOp=500\tops=100\tstddev=5.50\tci95=1.50\tsamples=20",
+	}
+	samples, err := readCozProfFile(lines)
+	if err != nil {
+		t.Fatalf("readCozProfFile: %v", err)
+	}
+	if len(samples) != 1 {
+		t.Fatalf("got %d samples, want 1", len(samples))
+	}
+	s := samples[0]
+	if s.nsPerOp != 500 || s.ops != 100 {
+		t.Errorf("latency-point nsPerOp/ops = %d/%d, want 500/100", s.nsPerOp, s.ops)
+	}
+}
+
+// TestReadCozProfFileThroughputPointDerivesNsPerOp guards against
+// readCozProfFile leaving nsPerOp at zero for throughput-point records
+// (the Coz format only carries "delta" for these, unlike latency
+// points). report/significant treat nsPerOp as meaningful for every
+// sample kind, so a zero here would divide by zero computing percent
+// speedup for any Coz profile with throughput points.
+func TestReadCozProfFileThroughputPointDerivesNsPerOp(t *testing.T) {
+	lines := []string{
+		"experiment\tselected-file=a.go\tselected-line=10\tspeedup=0.10\tduration=1000000",
+		"throughput-point\tname=ops\tdelta=100\tstddev=5.50\tci95=1.50\tsamples=20",
+	}
+	samples, err := readCozProfFile(lines)
+	if err != nil {
+		t.Fatalf("readCozProfFile: %v", err)
+	}
+	if len(samples) != 1 {
+		t.Fatalf("got %d samples, want 1", len(samples))
+	}
+	s := samples[0]
+	if s.ops != 100 {
+		t.Fatalf("ops = %d, want 100", s.ops)
+	}
+	if s.nsPerOp == 0 {
+		t.Errorf("nsPerOp = 0, want a value derived from duration/ops")
+	}
+	if want := s.duration / s.ops; s.nsPerOp != want {
+		t.Errorf("nsPerOp = %d, want duration/ops = %d", s.nsPerOp, want)
+	}
+}
+
+func TestSampleSignificant(t *testing.T) {
+	null := &sample{nsPerOp: 1000, ci95: 10}
+	close := &sample{nsPerOp: 1005, ci95: 10}
+	if close.significant(null) {
+		t.Errorf("significant() = true for a difference within combined CI, want false")
+	}
+	distinct := &sample{nsPerOp: 1100, ci95: 10}
+	if !distinct.significant(null) {
+		t.Errorf("significant() = false for a difference well outside combined CI, want true")
+	}
+}
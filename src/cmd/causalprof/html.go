@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"os"
+	"sort"
+)
+
+const (
+	plotWidth   = 220
+	plotHeight  = 160
+	plotMargin  = 24
+	plotsPerRow = 4
+)
+
+// writeHTMLReport renders one small-multiples SVG plot per (call site,
+// progress point) pair to path, with virtual speedup on the x-axis and
+// program speedup on the y-axis, and a zero line marking no effect.
+func writeHTMLReport(path string, index map[callsite]map[string][]*sample) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sites := make([]callsite, 0, len(index))
+	for cs := range index {
+		sites = append(sites, cs)
+	}
+	sort.Slice(sites, func(i, j int) bool {
+		if sites[i].file != sites[j].file {
+			return sites[i].file < sites[j].file
+		}
+		return sites[i].line < sites[j].line
+	})
+
+	fmt.Fprintln(f, "<!DOCTYPE html>")
+	fmt.Fprintln(f, "<html><head><title>causalprof speedup plots</title></head><body>")
+	fmt.Fprintf(f, "<div style=\"display:flex;flex-wrap:wrap;max-width:%dpx\">\n", plotsPerRow*(plotWidth+plotMargin))
+	for _, cs := range sites {
+		bypoint := index[cs]
+		points := make([]string, 0, len(bypoint))
+		for point := range bypoint {
+			points = append(points, point)
+		}
+		sort.Strings(points)
+		for _, point := range points {
+			samples := bypoint[point]
+			null := findNull(samples)
+			if null == nil {
+				continue
+			}
+			writeSitePlot(f, cs, point, samples, null)
+		}
+	}
+	fmt.Fprintln(f, "</div></body></html>")
+	return nil
+}
+
+func writeSitePlot(f *os.File, cs callsite, point string, samples []*sample, null *sample) {
+	w, h, m := float64(plotWidth), float64(plotHeight), float64(plotMargin)
+
+	x := func(virtualSpeedup int) float64 { return m + float64(virtualSpeedup)/100*(w-2*m) }
+	y := func(programSpeedup float64) float64 { return h/2 - programSpeedup/100*(h/2-m) }
+
+	title := html.EscapeString(fmt.Sprintf("%s:%d [%s]", cs.file, cs.line, point))
+	fmt.Fprintf(f, "<svg width=\"%d\" height=\"%d\" style=\"margin:4px;border:1px solid #ccc\">\n", plotWidth, plotHeight)
+	fmt.Fprintf(f, "<text x=\"%d\" y=\"12\" font-size=\"10\">%s</text>\n", plotMargin, title)
+	// zero line: no program speedup regardless of virtual speedup
+	fmt.Fprintf(f, "<line x1=\"%.1f\" y1=\"%.1f\" x2=\"%.1f\" y2=\"%.1f\" stroke=\"#999\" stroke-dasharray=\"2,2\"/>\n",
+		x(0), y(0), x(100), y(0))
+
+	type plotPoint struct{ x, y float64 }
+	var plotted []plotPoint
+	for _, s := range samples {
+		percent := float64(s.nsPerOp-null.nsPerOp) / float64(null.nsPerOp) * 100
+		// a speedup in runtime shows up as a negative change in ns/op
+		plotted = append(plotted, plotPoint{x(s.speedup), y(-percent)})
+	}
+	sort.Slice(plotted, func(i, j int) bool { return plotted[i].x < plotted[j].x })
+
+	fmt.Fprint(f, "<polyline fill=\"none\" stroke=\"steelblue\" stroke-width=\"1.5\" points=\"")
+	for _, p := range plotted {
+		fmt.Fprintf(f, "%.1f,%.1f ", p.x, p.y)
+	}
+	fmt.Fprintln(f, "\"/>")
+	for _, p := range plotted {
+		fmt.Fprintf(f, "<circle cx=\"%.1f\" cy=\"%.1f\" r=\"2\" fill=\"steelblue\"/>\n", p.x, p.y)
+	}
+	fmt.Fprintln(f, "</svg>")
+}
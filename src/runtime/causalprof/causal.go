@@ -7,9 +7,12 @@
 package causalprof
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
+	"path/filepath"
 	"runtime"
 	"runtime/pprof"
 	"sync"
@@ -20,11 +23,110 @@ var cpu struct {
 	sync.Mutex
 	profiling bool
 	done      chan bool
+	opts      Options
+}
+
+// Scope controls which program counters a causal profiling run will
+// consider for experiments.
+type Scope int
+
+const (
+	// FunctionEntry restricts experiments to the PC the runtime hands back
+	// for a function's entry, as in the original Coz implementation.
+	FunctionEntry Scope = iota
+	// LineLevel allows experiments at any in-scope line reached while
+	// profiling, not just function entry.
+	LineLevel
+)
+
+// Format selects the representation causal profiling results are written in.
+type Format int
+
+const (
+	// Text writes one line per result with seven whitespace-separated
+	// fields: pc, speedup percentage, ns/op, ops, samples, stddev and
+	// ci95, preceded by '#' comment lines giving the callsite, the
+	// "# point <name> <kind>" header and a human-readable summary.
+	Text Format = iota
+	// JSON writes a stream of one JSON object per experiment result, see Result.
+	JSON
+	// Coz writes experiment/throughput-point/latency-point line records
+	// in a layout inspired by the Coz profiler's own. It uses this
+	// tool's own field names rather than upstream Coz's, so it is not
+	// read by the upstream Coz viewer -- only by this tool's own reader.
+	Coz
+)
+
+// Options configures a causal profiling run started with Start.
+type Options struct {
+	// Scope selects whether experiments are restricted to function entry
+	// PCs or may run at any line. The zero value is FunctionEntry.
+	Scope Scope
+	// Include, if non-empty, restricts experiments to source files whose
+	// path matches one of these patterns (see path/filepath.Match).
+	// Ignored when Scope is FunctionEntry.
+	Include []string
+	// Exclude skips files matching one of these patterns, even if they
+	// also match Include. Like Include, it is ignored when Scope is
+	// FunctionEntry.
+	Exclude []string
+	// Format selects the output format. The zero value is Text.
+	Format Format
+
+	// Precision is the fraction of the mean nsPerOp that the 95%
+	// confidence interval must shrink below before an experiment's
+	// measurement is accepted; smaller values demand more samples. The
+	// zero value uses DefaultPrecision.
+	Precision float64
+	// MaxExperimentTime bounds how long a single experiment may keep
+	// sampling while waiting to reach Precision. The zero value uses
+	// DefaultMaxExperimentTime.
+	MaxExperimentTime time.Duration
+}
+
+// DefaultPrecision is the Precision used when Options.Precision is zero.
+const DefaultPrecision = 0.05
+
+// DefaultMaxExperimentTime is the MaxExperimentTime used when
+// Options.MaxExperimentTime is zero.
+const DefaultMaxExperimentTime = 5 * time.Second
+
+// sampleInterval is how often a running experiment re-samples every
+// registered point's progress to feed the running mean/variance.
+const sampleInterval = 50 * time.Millisecond
+
+// Result describes the outcome of a single causal profiling experiment
+// against a single registered progress point. It is the record written
+// out when Options.Format is JSON.
+type Result struct {
+	PC      uintptr `json:"pc"`
+	File    string  `json:"file"`
+	Line    int     `json:"line"`
+	Func    string  `json:"func"`
+	Speedup int     `json:"speedup"` // virtual speedup applied, in percent
+
+	// Point and Kind identify the progress point this result measures;
+	// see RegisterThroughput and RegisterLatency.
+	Point   string `json:"point"`
+	Kind    string `json:"kind"`
+	NsPerOp int64  `json:"nsPerOp"`
+	Ops     int64  `json:"ops"`
+
+	// Samples, StdDev and CI95 describe the sampling behind NsPerOp:
+	// the number of sampleInterval-sized measurements averaged together,
+	// their standard deviation, and the half-width of the 95% confidence
+	// interval of the mean (both in nanoseconds).
+	Samples int     `json:"samples"`
+	StdDev  float64 `json:"stddev"`
+	CI95    float64 `json:"ci95"`
+
+	// RunDuration is how long the experiment ran for, in nanoseconds.
+	RunDuration int64 `json:"runDuration"`
 }
 
 // Start enables causal profiling. While running, results of causal profiling experiments will
 // be written to w. Start returns an error if causal profiling or CPU profiling is already enabled.
-func Start(w io.Writer) error {
+func Start(w io.Writer, opts Options) error {
 	cpu.Lock()
 	defer cpu.Unlock()
 	if cpu.done == nil {
@@ -39,8 +141,10 @@ func Start(w io.Writer) error {
 		return fmt.Errorf("cpu profiling already in use")
 	}
 	cpu.profiling = true
+	cpu.opts = opts
 	runtime.SetCPUProfileRate(profilingHz)
-	go profileWriter(w)
+	runtime_causalProfileSetScope(opts.Scope == LineLevel)
+	go profileWriter(w, opts)
 	return nil
 }
 
@@ -71,73 +175,367 @@ func Stop() {
 	}
 }
 
+// site identifies an experiment site. With Scope == LineLevel, pc alone
+// already distinguishes lines within the same function, but we also keep
+// the resolved line so sites can be grouped and reported by file:line.
+type site struct {
+	pc   uintptr
+	line int
+}
+
+// welford accumulates a running mean and variance using Welford's
+// algorithm, letting us compute a confidence interval without keeping
+// every sample around.
+type welford struct {
+	n    int64
+	mean float64
+	m2   float64
+}
+
+func (w *welford) add(x float64) {
+	w.n++
+	delta := x - w.mean
+	w.mean += delta / float64(w.n)
+	w.m2 += delta * (x - w.mean)
+}
+
+func (w *welford) variance() float64 {
+	if w.n < 2 {
+		return 0
+	}
+	return w.m2 / float64(w.n-1)
+}
+
+func (w *welford) stddev() float64 { return math.Sqrt(w.variance()) }
+
+// ci95 returns the half-width of the 95% confidence interval of the mean.
+// It is +Inf until there are at least two samples.
+func (w *welford) ci95() float64 {
+	if w.n < 2 {
+		return math.Inf(1)
+	}
+	return 1.96 * w.stddev() / math.Sqrt(float64(w.n))
+}
+
+// overlaps reports whether a and b's 95% confidence intervals overlap,
+// i.e. whether the two means are not yet statistically distinguishable.
+func (a *welford) overlaps(b *welford) bool {
+	if a.n < 2 || b.n < 2 {
+		return true
+	}
+	lo := a.mean - a.ci95()
+	hi := a.mean + a.ci95()
+	blo := b.mean - b.ci95()
+	bhi := b.mean + b.ci95()
+	return lo <= bhi && blo <= hi
+}
+
+// experiment tracks, per experiment site, which virtual speedups have
+// been tried and the accumulated mean ns/op seen at each one across every
+// repeat run. runs[0] is the null (0% speedup) experiment.
 type experiment struct {
 	hasNull   bool
 	remaining []int
+	runs      map[int]*welford
 }
 
-func profileWriter(w io.Writer) {
-	experiments := make(map[uintptr]*experiment)
+// maxRunsPerPercent caps how many times the bandit scheduler will repeat
+// a given speedup at one site once every speedup has been tried once.
+const maxRunsPerPercent = 10
+
+// inScope reports whether file is eligible for experiments under opts.
+func inScope(file string, opts Options) bool {
+	if len(opts.Include) > 0 {
+		matched := false
+		for _, pat := range opts.Include {
+			if ok, _ := filepath.Match(pat, file); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	for _, pat := range opts.Exclude {
+		if ok, _ := filepath.Match(pat, file); ok {
+			return false
+		}
+	}
+	return true
+}
+
+func profileWriter(w io.Writer, opts Options) {
+	experiments := make(map[site]*experiment)
 	for {
 		pc := runtime_causalProfileStart()
 		if pc == 0 {
 			<-cpu.done
 			break
 		}
-		expinfo, ok := experiments[pc]
+		_func := runtime.FuncForPC(pc)
+		file, line := _func.FileLine(pc)
+		if opts.Scope == LineLevel && !inScope(file, opts) {
+			runtime_causalProfileInstall(0)
+			continue
+		}
+		key := site{pc: pc, line: line}
+		expinfo, ok := experiments[key]
 		if !ok {
 			expinfo = &experiment{
 				remaining: rand.Perm(20),
+				runs:      make(map[int]*welford),
 			}
-			experiments[pc] = expinfo
+			experiments[key] = expinfo
 		}
-		exp := selectExperiment(expinfo)
-		if exp == -1 {
+		percent := selectExperiment(expinfo)
+		if percent == -1 {
 			runtime_causalProfileInstall(0)
 			continue
 		}
-		delaypersample := uint64(exp) * (5 * delayPerPercent)
+		delaypersample := uint64(percent) * (5 * delayPerPercent)
+
+		stats, ok := runExperiment(opts, delaypersample)
+		if !ok {
+			return // causal profiling was stopped mid-experiment
+		}
+		if len(stats.perPoint) == 0 {
+			continue
+		}
+
+		// Feed the site's primary point's result into its history, so
+		// the bandit scheduler in selectExperiment can tell whether this
+		// speedup is distinguishable from the null. All points are still
+		// written to output below regardless of which one drives the
+		// schedule.
+		if p := primaryPoint(stats.perPoint); p != nil {
+			run := expinfo.runs[percent]
+			if run == nil {
+				run = &welford{}
+				expinfo.runs[percent] = run
+			}
+			run.add(p.nsPerOp)
+		}
+
+		for _, p := range stats.perPoint {
+			writeResult(w, opts.Format, Result{
+				PC:          pc,
+				File:        file,
+				Line:        line,
+				Func:        _func.Name(),
+				Speedup:     percent * 5,
+				Point:       p.name,
+				Kind:        p.kind.String(),
+				NsPerOp:     int64(p.nsPerOp),
+				Ops:         p.ops,
+				Samples:     int(p.samples),
+				StdDev:      p.stddev,
+				CI95:        p.ci95,
+				RunDuration: int64(stats.runDuration),
+			})
+		}
+		// allow currently sleeping goroutines to return to normal
+		time.Sleep(1000 * (time.Second / profilingHz))
+	}
+}
+
+// pointResult is the adaptively-sampled measurement for one progress
+// point over a single experiment.
+type pointResult struct {
+	name    string
+	kind    pointKind
+	nsPerOp float64
+	ops     int64
+	samples int64
+	stddev  float64
+	ci95    float64
+}
+
+type experimentStats struct {
+	perPoint    []pointResult
+	runDuration time.Duration
+}
+
+// primaryPoint picks the progress point that drives a site's bandit
+// schedule when a program registers more than one. The original Coz
+// design assumes a single progress point; rather than let an arbitrary
+// one (whichever happens to report data and come first) silently decide
+// when a site stops getting sampled, we prefer a latency point, since
+// end-to-end latency is the effect Coz recommends optimizing for, and
+// fall back to the first point reported otherwise. Every point is still
+// written to output regardless of this choice.
+func primaryPoint(perPoint []pointResult) *pointResult {
+	for i := range perPoint {
+		if perPoint[i].kind == latencyPoint {
+			return &perPoint[i]
+		}
+	}
+	if len(perPoint) == 0 {
+		return nil
+	}
+	return &perPoint[0]
+}
+
+// runExperiment installs delaypersample and repeatedly samples every
+// registered point's progress every sampleInterval, accumulating a
+// running mean/variance per point, until each active point's 95%
+// confidence interval has shrunk below opts.Precision of its mean or
+// opts.MaxExperimentTime has elapsed. It reports ok == false if causal
+// profiling was stopped while the experiment was running.
+func runExperiment(opts Options, delaypersample uint64) (stats experimentStats, ok bool) {
+	precision := opts.Precision
+	if precision <= 0 {
+		precision = DefaultPrecision
+	}
+	maxTime := opts.MaxExperimentTime
+	if maxTime <= 0 {
+		maxTime = DefaultMaxExperimentTime
+	}
 
-		resetProgress()
-		runtime_causalProfileInstall(delaypersample)
-		// TODO (dmo): variable sleep
+	prev := snapshotPoints()
+	runtime_causalProfileInstall(delaypersample)
+	runStart := time.Now()
+
+	welfords := make([]welford, len(prev.points))
+	totalOps := make([]int64, len(prev.points))
+	sawData := false
+	ticker := time.NewTicker(sampleInterval)
+	defer ticker.Stop()
+	for {
 		select {
-		case <-time.After(1000 * (time.Second / profilingHz)):
+		case <-ticker.C:
 		case <-cpu.done:
 			runtime_causalProfileInstall(0)
-			return
+			return experimentStats{}, false
+		}
+		cur := snapshotPoints()
+		for i, before := range prev.points {
+			after := cur.points[i].state
+			ops := after.ops - before.state.ops
+			if ops <= 0 {
+				continue
+			}
+			sawData = true
+			totalOps[i] += ops
+			var ns float64
+			switch before.kind {
+			case throughputPoint:
+				ns = float64(sampleInterval) / float64(ops)
+			case latencyPoint:
+				ns = float64(after.total-before.state.total) / float64(ops)
+			}
+			welfords[i].add(ns)
+		}
+		prev = cur
+		if (sawData && pointsConverged(welfords, precision)) || time.Since(runStart) >= maxTime {
+			break
 		}
-		runtime_causalProfileInstall(0)
-		diff := compareprogress()
-		if diff == -1 {
+	}
+	runtime_causalProfileInstall(0)
+	runDuration := time.Since(runStart)
+
+	var results []pointResult
+	for i, p := range prev.points {
+		if welfords[i].n == 0 {
 			continue
 		}
-		_func := runtime.FuncForPC(pc)
-		file, line := _func.FileLine(pc)
-		fmt.Fprintf(w, "# %s %s:%d\n", _func.Name(), file, line)
-		fmt.Fprintf(w, "# speedup %d%%\n", delaypersample/delayPerPercent)
-		fmt.Fprintf(w, "# %dns/op\n", diff)
-		fmt.Fprintf(w, "%#x %d %d\n", pc, delaypersample/delayPerPercent, diff)
-		// allow currently sleeping goroutines to return to normal
-		time.Sleep(1000 * (time.Second / profilingHz))
+		results = append(results, pointResult{
+			name:    p.name,
+			kind:    p.kind,
+			nsPerOp: welfords[i].mean,
+			ops:     totalOps[i],
+			samples: welfords[i].n,
+			stddev:  welfords[i].stddev(),
+			ci95:    welfords[i].ci95(),
+		})
 	}
+	return experimentStats{perPoint: results, runDuration: runDuration}, true
 }
 
+// pointsConverged reports whether every point that has reported at
+// least one sample in welfords has a 95% CI within precision of its
+// mean. A point that hasn't reported any data yet (e.g. it idled for
+// this tick, or the whole run) doesn't count either way: an idle tick
+// must not let points that are still wide declare victory just because
+// nothing else happened to move this interval.
+func pointsConverged(welfords []welford, precision float64) bool {
+	for i := range welfords {
+		if welfords[i].n == 0 {
+			continue
+		}
+		if welfords[i].n < 2 || welfords[i].ci95() > precision*math.Abs(welfords[i].mean) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeResult writes r to w in the given format.
+func writeResult(w io.Writer, format Format, r Result) {
+	switch format {
+	case JSON:
+		json.NewEncoder(w).Encode(r)
+	case Coz:
+		fmt.Fprintf(w, "experiment\tselected-file=%s\tselected-line=%d\tspeedup=%.2f\tduration=%d\n",
+			r.File, r.Line, float64(r.Speedup)/100, r.RunDuration)
+		if r.Kind == latencyPoint.String() {
+			fmt.Fprintf(w, "latency-point\tname=%s\tnsPerOp=%d\tops=%d\tstddev=%.2f\tci95=%.2f\tsamples=%d\n",
+				r.Point, r.NsPerOp, r.Ops, r.StdDev, r.CI95, r.Samples)
+		} else {
+			fmt.Fprintf(w, "throughput-point\tname=%s\tdelta=%d\tstddev=%.2f\tci95=%.2f\tsamples=%d\n",
+				r.Point, r.Ops, r.StdDev, r.CI95, r.Samples)
+		}
+	default:
+		fmt.Fprintf(w, "# %s %s:%d\n", r.Func, r.File, r.Line)
+		fmt.Fprintf(w, "# speedup %d%%\n", r.Speedup)
+		fmt.Fprintf(w, "# point %s %s\n", r.Point, r.Kind)
+		fmt.Fprintf(w, "# %dns/op +/- %.0f (%d samples)\n", r.NsPerOp, r.CI95, r.Samples)
+		fmt.Fprintf(w, "%#x %d %d %d %d %.2f %.2f\n", r.PC, r.Speedup, r.NsPerOp, r.Ops, r.Samples, r.StdDev, r.CI95)
+	}
+}
+
+// selectExperiment picks the next virtual speedup (0-20, in units of 5%)
+// to run at a site. It first makes sure the null and every speedup has
+// been tried once, in a random order, then switches to a bandit-style
+// scheduler that keeps sampling whichever speedup's confidence interval
+// still overlaps the null's — i.e. whichever one we're least sure is a
+// real effect yet — up to maxRunsPerPercent times each. The null itself
+// stays in that rotation throughout the site's lifetime, since overlaps
+// can't tell speedups apart from a null whose own CI was never
+// refined past a single sample. It returns -1 once nothing is left
+// worth sampling.
 func selectExperiment(expinfo *experiment) int {
 	if !expinfo.hasNull && rand.Intn(2) == 1 {
 		expinfo.hasNull = true
 		return 0
 	}
-	if len(expinfo.remaining) == 0 {
-		if !expinfo.hasNull {
-			expinfo.hasNull = true
-			return 0
+	if len(expinfo.remaining) > 0 {
+		exp := expinfo.remaining[0] + 1
+		expinfo.remaining = expinfo.remaining[1:]
+		return exp
+	}
+	if !expinfo.hasNull {
+		expinfo.hasNull = true
+		return 0
+	}
+
+	null := expinfo.runs[0]
+	best := -1
+	var worstCI float64
+	for percent := 0; percent <= 20; percent++ {
+		run := expinfo.runs[percent]
+		if run == nil || run.n >= maxRunsPerPercent {
+			continue
+		}
+		if percent != 0 && null != nil && !null.overlaps(run) {
+			continue // already statistically distinguishable from the null
+		}
+		ci := run.ci95()
+		if best == -1 || ci > worstCI {
+			best, worstCI = percent, ci
 		}
-		return -1
 	}
-	exp := expinfo.remaining[0] + 1
-	expinfo.remaining = expinfo.remaining[1:]
-	return exp
+	return best
 }
 
 func runtime_causalProfileStart() uintptr
@@ -145,45 +543,153 @@ func runtime_causalProfileInstall(delay uint64)
 func runtime_causalProfileGetDelay() uint64
 func runtime_causalProfileWakeup()
 
-var progress int
-var progresstime time.Duration
-var progressmu sync.Mutex
+// runtime_causalProfileSetScope tells the runtime's CPU profile signal
+// handler whether to hand back only function-entry PCs (lineLevel == false)
+// or any in-scope PC it samples (lineLevel == true).
+func runtime_causalProfileSetScope(lineLevel bool)
+
+// pointKind distinguishes the two kinds of progress point a program can
+// register: a throughput point just counts completed operations, while a
+// latency point also tracks the time spent per operation.
+type pointKind int
 
-func resetProgress() {
-	progressmu.Lock()
-	defer progressmu.Unlock()
-	progress = 0
-	progresstime = 0
+const (
+	throughputPoint pointKind = iota
+	latencyPoint
+)
+
+func (k pointKind) String() string {
+	if k == latencyPoint {
+		return "latency"
+	}
+	return "throughput"
 }
 
-type Progress struct {
-	startTime  time.Time
-	startDelay uint64
+// pointState is a point's value at some instant, sampled at the start of
+// an experiment and again every sampleInterval so runExperiment can
+// compute the delta over each interval.
+type pointState struct {
+	ops   int64
+	total time.Duration
 }
 
-func StartProgress() Progress {
-	return Progress{
-		startTime:  time.Now(),
-		startDelay: runtime_causalProfileGetDelay(),
-	}
+// registeredPoint pairs a snapshot of a point's state with the name and
+// kind needed to report it.
+type registeredPoint struct {
+	name  string
+	kind  pointKind
+	state pointState
 }
 
-func (p *Progress) Stop() {
-	t := time.Since(p.startTime)
-	d := runtime_causalProfileGetDelay() - p.startDelay
-	t -= time.Duration(d)
-	progressmu.Lock()
-	defer progressmu.Unlock()
-	progresstime += t
-	progress += 1
+type pointsSnapshot struct {
+	points []registeredPoint
 }
 
-func compareprogress() int {
-	progressmu.Lock()
-	defer progressmu.Unlock()
-	if progress == 0 {
-		return -1
+var points struct {
+	sync.Mutex
+	all []interface {
+		name() string
+		kind() pointKind
+		snapshot() pointState
 	}
+}
+
+// snapshotPoints records the current state of every registered progress
+// point. runExperiment calls it when an experiment starts and on every
+// sampleInterval tick, and diffs consecutive snapshots to measure the
+// effect on every point at once.
+func snapshotPoints() pointsSnapshot {
+	points.Lock()
+	defer points.Unlock()
+	s := pointsSnapshot{points: make([]registeredPoint, len(points.all))}
+	for i, p := range points.all {
+		s.points[i] = registeredPoint{name: p.name(), kind: p.kind(), state: p.snapshot()}
+	}
+	return s
+}
+
+// Counter is a named throughput progress point registered with
+// RegisterThroughput. Call Inc each time the program completes one unit
+// of the workload the counter measures.
+type Counter struct {
+	pointName string
+	mu        sync.Mutex
+	n         int64
+}
+
+// RegisterThroughput registers a new throughput progress point called
+// name and returns a Counter to report progress against it.
+func RegisterThroughput(name string) *Counter {
+	c := &Counter{pointName: name}
+	points.Lock()
+	points.all = append(points.all, c)
+	points.Unlock()
+	return c
+}
 
-	return int(int64(progresstime) / int64(progress))
-}
\ No newline at end of file
+// Inc records that one unit of work has completed.
+func (c *Counter) Inc() {
+	c.mu.Lock()
+	c.n++
+	c.mu.Unlock()
+}
+
+func (c *Counter) name() string    { return c.pointName }
+func (c *Counter) kind() pointKind { return throughputPoint }
+func (c *Counter) snapshot() pointState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return pointState{ops: c.n}
+}
+
+// Timer is a named latency progress point registered with
+// RegisterLatency. Call Begin around each unit of work the timer
+// measures and End the returned Span when it completes.
+type Timer struct {
+	pointName string
+	mu        sync.Mutex
+	total     time.Duration
+	n         int64
+}
+
+// RegisterLatency registers a new latency progress point called name
+// and returns a Timer to report progress against it.
+func RegisterLatency(name string) *Timer {
+	t := &Timer{pointName: name}
+	points.Lock()
+	points.all = append(points.all, t)
+	points.Unlock()
+	return t
+}
+
+// Span is an in-progress unit of work started by Timer.Begin.
+type Span struct {
+	t          *Timer
+	startTime  time.Time
+	startDelay uint64
+}
+
+// Begin starts timing a unit of work.
+func (t *Timer) Begin() *Span {
+	return &Span{t: t, startTime: time.Now(), startDelay: runtime_causalProfileGetDelay()}
+}
+
+// End records that the unit of work started by Begin has completed. Time
+// spent inside causal profiling's virtual slowdown is excluded so it
+// doesn't get counted against the program.
+func (s *Span) End() {
+	d := runtime_causalProfileGetDelay() - s.startDelay
+	elapsed := time.Since(s.startTime) - time.Duration(d)
+	s.t.mu.Lock()
+	s.t.total += elapsed
+	s.t.n++
+	s.t.mu.Unlock()
+}
+
+func (t *Timer) name() string    { return t.pointName }
+func (t *Timer) kind() pointKind { return latencyPoint }
+func (t *Timer) snapshot() pointState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return pointState{ops: t.n, total: t.total}
+}
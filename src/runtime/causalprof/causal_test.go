@@ -0,0 +1,175 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package causalprof
+
+import (
+	"math"
+	"testing"
+)
+
+func TestWelfordMeanAndCI(t *testing.T) {
+	var w welford
+	for _, x := range []float64{10, 12, 11, 13, 9} {
+		w.add(x)
+	}
+	if w.n != 5 {
+		t.Fatalf("n = %d, want 5", w.n)
+	}
+	if got, want := w.mean, 11.0; got != want {
+		t.Errorf("mean = %v, want %v", got, want)
+	}
+	if w.ci95() <= 0 || w.ci95() == w.stddev() {
+		t.Errorf("ci95 = %v, want a positive value shrunk by sample size", w.ci95())
+	}
+}
+
+func TestWelfordCI95UndefinedBelowTwoSamples(t *testing.T) {
+	var w welford
+	if got := w.ci95(); !math.IsInf(got, 1) {
+		t.Errorf("ci95 with 0 samples = %v, want +Inf", got)
+	}
+	w.add(5)
+	if got := w.ci95(); !math.IsInf(got, 1) {
+		t.Errorf("ci95 with 1 sample = %v, want +Inf", got)
+	}
+}
+
+func TestWelfordOverlaps(t *testing.T) {
+	var a, b welford
+	// Fewer than two samples on either side: can't tell them apart yet.
+	if !a.overlaps(&b) {
+		t.Errorf("a.overlaps(b) = false with no samples, want true")
+	}
+	for _, x := range []float64{100, 101, 99, 100, 101} {
+		a.add(x)
+	}
+	for _, x := range []float64{100, 99, 101, 100, 99} {
+		b.add(x)
+	}
+	if !a.overlaps(&b) {
+		t.Errorf("a.overlaps(b) = false for indistinguishable means, want true")
+	}
+	var c welford
+	for _, x := range []float64{1000, 1001, 999, 1000, 1001} {
+		c.add(x)
+	}
+	if a.overlaps(&c) {
+		t.Errorf("a.overlaps(c) = true for clearly separated means, want false")
+	}
+}
+
+// TestSelectExperimentKeepsSamplingNull verifies that, once every speedup
+// has been tried once, the bandit scheduler keeps revisiting the null
+// (0%) experiment instead of only ever sampling it a single time. A null
+// stuck at n==1 makes welford.overlaps always report true, which would
+// defeat the whole point of the significance-aware scheduler: see
+// selectExperiment.
+func TestSelectExperimentKeepsSamplingNull(t *testing.T) {
+	expinfo := &experiment{
+		hasNull: true,
+		runs:    make(map[int]*welford),
+	}
+	// Every speedup, including the null, has already been tried once with
+	// a tight, clearly-separated mean so overlaps can in principle resolve.
+	for percent := 0; percent <= 20; percent++ {
+		w := &welford{}
+		w.add(float64(1000 + percent))
+		expinfo.runs[percent] = w
+	}
+
+	sawNullAgain := false
+	for i := 0; i < maxRunsPerPercent*21; i++ {
+		percent := selectExperiment(expinfo)
+		if percent == -1 {
+			break
+		}
+		run := expinfo.runs[percent]
+		if run == nil {
+			run = &welford{}
+			expinfo.runs[percent] = run
+		}
+		run.add(float64(1000 + percent))
+		if percent == 0 && run.n > 1 {
+			sawNullAgain = true
+		}
+	}
+	if !sawNullAgain {
+		t.Errorf("selectExperiment never revisited the null experiment beyond its first sample")
+	}
+}
+
+// TestPrimaryPointPrefersLatency verifies that a site affecting more
+// than one progress point always has its schedule driven by the same
+// deliberately-chosen point -- a latency point when one was reported --
+// rather than whichever point happened to come first in registration
+// order.
+func TestPrimaryPointPrefersLatency(t *testing.T) {
+	perPoint := []pointResult{
+		{name: "requests", kind: throughputPoint, nsPerOp: 10},
+		{name: "request-latency", kind: latencyPoint, nsPerOp: 20},
+	}
+	got := primaryPoint(perPoint)
+	if got == nil || got.name != "request-latency" {
+		t.Errorf("primaryPoint() = %+v, want the latency point", got)
+	}
+}
+
+func TestPrimaryPointFallsBackToFirst(t *testing.T) {
+	perPoint := []pointResult{
+		{name: "requests", kind: throughputPoint, nsPerOp: 10},
+		{name: "bytes", kind: throughputPoint, nsPerOp: 20},
+	}
+	got := primaryPoint(perPoint)
+	if got == nil || got.name != "requests" {
+		t.Errorf("primaryPoint() = %+v, want the first point when none are latency points", got)
+	}
+	if primaryPoint(nil) != nil {
+		t.Errorf("primaryPoint(nil) = non-nil, want nil")
+	}
+}
+
+// TestPointsConvergedIgnoresPointsWithNoData ensures a point that simply
+// hasn't reported anything yet (an idle tick, or a point this program
+// never drives) doesn't make pointsConverged report true on behalf of
+// other points that are still wide. Regression test for runExperiment's
+// convergence check only ever looking at points active in the current
+// tick instead of every point that has ever reported data.
+func TestPointsConvergedIgnoresPointsWithNoData(t *testing.T) {
+	wide := welford{}
+	wide.add(100)
+	wide.add(10000)   // huge variance, CI nowhere near converged
+	idle := welford{} // never reported any data at all
+
+	if pointsConverged([]welford{wide, idle}, DefaultPrecision) {
+		t.Errorf("pointsConverged() = true with a still-wide point present, want false")
+	}
+
+	tight := welford{}
+	for i := 0; i < 20; i++ {
+		tight.add(1000)
+	}
+	if !pointsConverged([]welford{tight, idle}, DefaultPrecision) {
+		t.Errorf("pointsConverged() = false, want true: idle point should not block convergence")
+	}
+}
+
+func TestSelectExperimentStopsOnceMaxedOutAndDistinguishable(t *testing.T) {
+	expinfo := &experiment{
+		hasNull: true,
+		runs:    make(map[int]*welford),
+	}
+	// Give every speedup, including the null, a long tight run that's
+	// clearly separated from every other speedup's mean.
+	for percent := 0; percent <= 20; percent++ {
+		w := &welford{}
+		for i := 0; i < maxRunsPerPercent; i++ {
+			w.add(float64(1000 + percent*100))
+		}
+		expinfo.runs[percent] = w
+	}
+	if got := selectExperiment(expinfo); got != -1 {
+		t.Errorf("selectExperiment() = %d, want -1 once every speedup is both maxed out and distinguishable", got)
+	}
+}